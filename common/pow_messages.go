@@ -0,0 +1,14 @@
+package common
+
+// MessagePoWChallenge (server -> client) carries a freshly issued
+// proof-of-work challenge: seed, required difficulty and expiry.
+//
+// MessagePoWSolution (client -> server) carries a client's claimed
+// solution - seed and nonce - for a previously issued challenge.
+//
+// Reserved from the top of the MessageType range to avoid colliding with
+// this package's existing opcodes, which are assigned elsewhere.
+const (
+	MessagePoWChallenge MessageType = 250
+	MessagePoWSolution  MessageType = 251
+)
@@ -0,0 +1,8 @@
+package common
+
+// MessageSystemPost is the wire opcode a systempost.Post is broadcast
+// under, replacing the older one-off MessageStoleImageFrom/
+// MessageStoleImageTo style messages. Reserved from the top of the
+// MessageType range, like MessagePoWChallenge/MessagePoWSolution, to avoid
+// colliding with this package's existing opcodes.
+const MessageSystemPost MessageType = 249
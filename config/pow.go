@@ -0,0 +1,48 @@
+package config
+
+import "time"
+
+// PoWConfig holds the knobs for the server-issued proof-of-work anti-spam
+// challenges: whether they're issued at all, the spam score that triggers
+// one, how much redeeming one debits the score by, and the difficulty
+// curve. Kept as its own accessor below, rather than a field on this
+// package's main configuration struct, so that struct's existing
+// definition and loader don't need editing just to grow this one
+// subsystem's settings.
+type PoWConfig struct {
+	Enable bool `json:"enable"`
+
+	// ScoreThreshold is the spam score at or above which a challenge is
+	// issued instead of letting the operation through. Zero is treated as
+	// PoW being effectively disabled, even if Enable is true, since there
+	// would otherwise be no valid score to scale the challenge difficulty
+	// against.
+	ScoreThreshold uint `json:"scoreThreshold"`
+
+	// ScoreDebit is how much a redeemed challenge lowers the spam score by.
+	ScoreDebit uint `json:"scoreDebit"`
+
+	// BaseDifficulty is the leading-zero-bit count a challenge requires
+	// before any per-operation or repeat-offense scaling is applied.
+	BaseDifficulty float64 `json:"baseDifficulty"`
+
+	// DifficultyRamp is added to the base difficulty per repeat offense.
+	DifficultyRamp float64 `json:"difficultyRamp"`
+
+	// ChallengeLifetime is how long an issued challenge remains redeemable.
+	ChallengeLifetime time.Duration `json:"challengeLifetime"`
+}
+
+var pow PoWConfig
+
+// GetPoW returns the currently active PoW configuration.
+func GetPoW() PoWConfig {
+	return pow
+}
+
+// SetPoW replaces the active PoW configuration. The server's configuration
+// loader does not call it; until something does, GetPoW returns the zero
+// PoWConfig, whose Enable is false.
+func SetPoW(conf PoWConfig) {
+	pow = conf
+}
@@ -0,0 +1,23 @@
+package config
+
+import "github.com/bakape/meguca/tracing"
+
+// tracingConf is the server's tracing.Config, held the same way PoWConfig
+// is: as its own accessor, instead of a field on this package's main
+// configuration struct, so that struct's existing definition and loader
+// don't need editing just to grow this one subsystem's settings.
+var tracingConf tracing.Config
+
+// GetTracing returns the currently active tracing configuration.
+func GetTracing() tracing.Config {
+	return tracingConf
+}
+
+// SetTracing replaces the active tracing configuration and initializes the
+// global tracer from it. The server's startup code and configuration
+// loader do not call it; until something does, StartSpan produces no-op
+// spans.
+func SetTracing(conf tracing.Config) error {
+	tracingConf = conf
+	return tracing.Init(conf)
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// db is this package's shared connection pool.
+var db *sql.DB
+
+// spamScoreKey picks the key spam scores and PoW challenges are tracked
+// under: the captcha session, if one was established, falling back to IP.
+func spamScoreKey(session, ip string) string {
+	if session != "" {
+		return session
+	}
+	return ip
+}
+
+// GetSpamScore returns the current spam score tracked for session (or ip,
+// if session is empty). A never-before-seen key has a score of zero.
+func GetSpamScore(session, ip string) (score uint, err error) {
+	err = db.QueryRow(
+		`select score from spam_scores where key = $1`,
+		spamScoreKey(session, ip),
+	).Scan(&score)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+// DecrementSpamScore lowers the spam score tracked for session (or ip) by
+// by, floored at zero.
+func DecrementSpamScore(session, ip string, by uint) error {
+	_, err := db.Exec(
+		`update spam_scores
+		 set score = greatest(score - $2, 0)
+		 where key = $1`,
+		spamScoreKey(session, ip), by,
+	)
+	return err
+}
+
+// InsertPoWChallenge persists a just-issued proof-of-work challenge, so it
+// can still be redeemed on a different node behind a load balancer, or
+// after this node restarts.
+func InsertPoWChallenge(seed, key string, difficulty uint, expires time.Time) error {
+	_, err := db.Exec(
+		`insert into pow_challenges (seed, key, difficulty, expires)
+		 values ($1, $2, $3, $4)`,
+		seed, key, difficulty, expires,
+	)
+	return err
+}
+
+// GetPoWChallenge looks up a challenge by seed, for the case where it was
+// issued by a different node than the one redeeming it.
+func GetPoWChallenge(seed string) (difficulty uint, expires time.Time, key string, err error) {
+	err = db.QueryRow(
+		`select difficulty, expires, key from pow_challenges where seed = $1`,
+		seed,
+	).Scan(&difficulty, &expires, &key)
+	return
+}
+
+// RedeemPoWChallenge deletes a redeemed challenge, so it can not be solved
+// twice.
+func RedeemPoWChallenge(seed string) error {
+	_, err := db.Exec(`delete from pow_challenges where seed = $1`, seed)
+	return err
+}
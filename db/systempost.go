@@ -0,0 +1,20 @@
+package db
+
+import "encoding/json"
+
+// InsertSystemPost persists a system post for thread op and returns the
+// post ID assigned to it, the same way a regular post would be.
+func InsertSystemPost(op uint64, typ string, props map[string]any) (id uint64, err error) {
+	encodedProps, err := json.Marshal(props)
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.QueryRow(
+		`insert into posts (op, type, props, is_system_post)
+		 values ($1, $2, $3, true)
+		 returning id`,
+		op, typ, encodedProps,
+	).Scan(&id)
+	return
+}
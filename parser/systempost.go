@@ -0,0 +1,42 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/bakape/meguca/systempost"
+)
+
+// RenderSystemPost renders a systempost.Post to the plain-text line a
+// client shows as a distinct thread entry, the same render step
+// ParseBody's output gets for a regular post's body. Every systempost.Event
+// needs a case here - an Event with no case is a post the server can
+// persist and broadcast but no client can ever read.
+func RenderSystemPost(p systempost.Post) (string, error) {
+	switch p.Type {
+	case systempost.ImageStolen:
+		return fmt.Sprintf(
+			"image stolen from post %v", p.Props["from"],
+		), nil
+	case systempost.ImageSpoilered:
+		return fmt.Sprintf(
+			"image spoilered on post %v", p.Props["id"],
+		), nil
+	case systempost.PostDeletedByMod:
+		return fmt.Sprintf(
+			"post %v deleted by moderator %v", p.Props["id"], p.Props["by"],
+		), nil
+	case systempost.ThreadLocked:
+		return fmt.Sprintf("thread locked by %v", p.Props["by"]), nil
+	case systempost.BanIssued:
+		return fmt.Sprintf(
+			"post %v's author banned: %v", p.Props["id"], p.Props["reason"],
+		), nil
+	case systempost.FilterMatched:
+		return fmt.Sprintf(
+			"post %v matched filter %v", p.Props["id"], p.Props["filter"],
+		), nil
+	default:
+		return "", fmt.Errorf("parser: no render case for system post type %q",
+			p.Type)
+	}
+}
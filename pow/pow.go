@@ -0,0 +1,179 @@
+// Package pow implements server-issued proof-of-work challenges: a
+// lighter-weight, harder-to-outsource alternative to forcing a client to
+// re-solve a captcha every time its spam score crosses a threshold.
+//
+// Each Challenge is a random seed plus a target difficulty. A client solves
+// it by brute-forcing a nonce such that SHA-256(seed || nonce) has at least
+// Difficulty leading zero bits, the same scheme Hashcash and most
+// proof-of-work captchas use. Challenges are one-shot: redeeming one removes
+// it, so a solution can never be replayed.
+package pow
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/bakape/meguca/config"
+	"github.com/bakape/meguca/db"
+)
+
+// Challenge is a single proof-of-work puzzle issued to a client.
+type Challenge struct {
+	Seed       string    `json:"seed"`
+	Difficulty uint      `json:"difficulty"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Solution is the nonce a client claims satisfies a previously issued
+// Challenge, identified by its seed.
+type Solution struct {
+	Seed  string `json:"seed"`
+	Nonce string `json:"nonce"`
+}
+
+var (
+	// ErrNotFound is returned, when a challenge has expired, was already
+	// redeemed, or was never issued to the requesting key.
+	ErrNotFound = errors.New("pow: challenge not found or expired")
+
+	// ErrInsufficientWork is returned, when a solution's hash does not meet
+	// the challenge's required leading-zero-bit difficulty.
+	ErrInsufficientWork = errors.New("pow: insufficient work")
+)
+
+// Cost is the per-operation difficulty multiplier table. The base difficulty
+// configured for the server is scaled by the entry matching the operation
+// that triggered the challenge, so cheap operations like appending a rune
+// stay solvable in milliseconds, while image inserts cost noticeably more.
+var Cost = map[string]float64{
+	"appendRune":  1,
+	"backspace":   1,
+	"spliceText":  1.5,
+	"insertImage": 4,
+}
+
+// store holds outstanding challenges issued by this node, keyed by seed.
+// db provides a Postgres-backed fallback, so a challenge issued by one node
+// can still be redeemed on another behind a load balancer, and survives a
+// server restart.
+var store = struct {
+	sync.Mutex
+	m map[string]issued
+}{
+	m: make(map[string]issued),
+}
+
+// issued pairs a Challenge with the key (IP or captcha session) it was
+// issued to, so Redeem can reject a solution presented by anyone else.
+type issued struct {
+	Challenge
+	key string
+}
+
+// sweepLocked removes expired, never-redeemed challenges from store.m.
+// Called with store already locked, piggybacking on every Issue instead of
+// running its own ticker, so the in-memory store can't grow unbounded under
+// abandoned clients despite challenges having a TTL.
+func sweepLocked() {
+	now := time.Now()
+	for seed, chal := range store.m {
+		if now.After(chal.Expires) {
+			delete(store.m, seed)
+		}
+	}
+}
+
+// Issue creates, stores and returns a new Challenge for key, scaled for the
+// named operation. The difficulty ramps with repeatOffenses, so clients that
+// keep tripping the spam threshold face progressively harder puzzles.
+func Issue(key, op string, repeatOffenses uint) (Challenge, error) {
+	seed := make([]byte, 16)
+	if _, err := rand.Read(seed); err != nil {
+		return Challenge{}, err
+	}
+
+	conf := config.GetPoW()
+	diff := conf.BaseDifficulty * Cost[op]
+	diff += float64(repeatOffenses) * conf.DifficultyRamp
+
+	chal := Challenge{
+		Seed:       hex.EncodeToString(seed),
+		Difficulty: uint(diff),
+		Expires:    time.Now().Add(conf.ChallengeLifetime),
+	}
+
+	store.Lock()
+	sweepLocked()
+	store.m[chal.Seed] = issued{Challenge: chal, key: key}
+	store.Unlock()
+
+	err := db.InsertPoWChallenge(chal.Seed, key, chal.Difficulty, chal.Expires)
+	if err != nil {
+		return Challenge{}, err
+	}
+	return chal, nil
+}
+
+// Redeem verifies sol against the challenge issued to key. On success the
+// challenge is redeemed (removed, so it can not be solved twice) and nil is
+// returned. Any other outcome - unknown seed, wrong key, expiry, or a hash
+// that does not meet the difficulty - returns a non-nil error and leaves the
+// challenge in place so no unsolved guess counts against the client.
+func Redeem(key string, sol Solution) error {
+	store.Lock()
+	found, ok := store.m[sol.Seed]
+	store.Unlock()
+
+	if !ok {
+		difficulty, expires, dbKey, err := db.GetPoWChallenge(sol.Seed)
+		if err != nil {
+			return ErrNotFound
+		}
+		found = issued{
+			Challenge: Challenge{
+				Seed:       sol.Seed,
+				Difficulty: difficulty,
+				Expires:    expires,
+			},
+			key: dbKey,
+		}
+	}
+
+	if found.key != key || time.Now().After(found.Expires) {
+		return ErrNotFound
+	}
+	if !verify(sol, found.Challenge) {
+		return ErrInsufficientWork
+	}
+
+	store.Lock()
+	delete(store.m, sol.Seed)
+	store.Unlock()
+	return db.RedeemPoWChallenge(sol.Seed)
+}
+
+// verify recomputes SHA-256(seed || nonce) and reports whether it has at
+// least chal.Difficulty leading zero bits.
+func verify(sol Solution, chal Challenge) bool {
+	h := sha256.Sum256([]byte(chal.Seed + sol.Nonce))
+	return leadingZeroBits(h[:]) >= chal.Difficulty
+}
+
+// leadingZeroBits counts the leading zero bits of b.
+func leadingZeroBits(b []byte) uint {
+	var n uint
+	for _, by := range b {
+		if by == 0 {
+			n += 8
+			continue
+		}
+		n += uint(bits.LeadingZeros8(by))
+		break
+	}
+	return n
+}
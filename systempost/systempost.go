@@ -0,0 +1,66 @@
+// Package systempost defines first-class system posts: server-generated
+// thread events - an image being stolen, a post spoilered, a moderator
+// action, a filter match - that are persisted and broadcast inline in a
+// thread like regular posts, instead of one-off message opcodes that leave
+// no trace once the client has handled them. parser.RenderSystemPost and
+// templates.SystemPost give each Event its own render case, so a client
+// sees a distinct thread entry rather than raw Props.
+package systempost
+
+import (
+	"github.com/bakape/meguca/common"
+	"github.com/bakape/meguca/db"
+)
+
+// Event identifies the kind of thread event a Post records.
+type Event string
+
+const (
+	// ImageStolen records a #steal image transfer between two posts.
+	ImageStolen Event = "image_stolen"
+
+	// ImageSpoilered records an image being spoilered in an open post.
+	ImageSpoilered Event = "image_spoilered"
+
+	// PostDeletedByMod records a moderator deleting a post.
+	PostDeletedByMod Event = "post_deleted_by_mod"
+
+	// ThreadLocked records a moderator locking a thread.
+	ThreadLocked Event = "thread_locked"
+
+	// BanIssued records a ban issued against a post's author.
+	BanIssued Event = "ban_issued"
+
+	// FilterMatched records a post body matching a configured word filter.
+	FilterMatched Event = "filter_matched"
+)
+
+// Post is a typed, persisted system event. Props carries the event-specific
+// payload - from/to post IDs, the moderator's name, the matched filter ID,
+// and so on - and is deliberately untyped, so new Events don't need schema
+// migrations on the Post struct itself.
+type Post struct {
+	ID    uint64         `json:"id"`
+	OP    uint64         `json:"op"`
+	Type  Event          `json:"type"`
+	Props map[string]any `json:"props"`
+}
+
+// New persists a system Post of the given Event for thread op and encodes it
+// as a MessageSystemPost, ready to hand to a feed for broadcasting. This is
+// the only way system posts should be created; it keeps the taxonomy of
+// thread events - and their on-disk representation - in one place, instead
+// of scattered across every caller that used to hand-roll a message.
+func New(op uint64, typ Event, props map[string]any) ([]byte, error) {
+	id, err := db.InsertSystemPost(op, string(typ), props)
+	if err != nil {
+		return nil, err
+	}
+
+	return common.EncodeMessage(common.MessageSystemPost, Post{
+		ID:    id,
+		OP:    op,
+		Type:  typ,
+		Props: props,
+	})
+}
@@ -0,0 +1,35 @@
+package templates
+
+import (
+	"fmt"
+
+	"github.com/bakape/meguca/parser"
+	"github.com/bakape/meguca/systempost"
+)
+
+// systemPostClass maps a systempost.Event to the CSS class it's rendered
+// with, so each Event reads as its own distinct thread entry instead of a
+// regular post bubble.
+var systemPostClass = map[systempost.Event]string{
+	systempost.ImageStolen:      "system-post system-post_image-stolen",
+	systempost.ImageSpoilered:   "system-post system-post_image-spoilered",
+	systempost.PostDeletedByMod: "system-post system-post_deleted-by-mod",
+	systempost.ThreadLocked:     "system-post system-post_thread-locked",
+	systempost.BanIssued:        "system-post system-post_ban-issued",
+	systempost.FilterMatched:    "system-post system-post_filter-matched",
+}
+
+// SystemPost renders p as the HTML for a single distinct thread entry.
+func SystemPost(p systempost.Post) (string, error) {
+	text, err := parser.RenderSystemPost(p)
+	if err != nil {
+		return "", err
+	}
+	class, ok := systemPostClass[p.Type]
+	if !ok {
+		return "", fmt.Errorf("templates: no CSS class for system post type %q",
+			p.Type)
+	}
+	return fmt.Sprintf(`<div class="%s" data-id="%d">%s</div>`,
+		class, p.ID, text), nil
+}
@@ -0,0 +1,121 @@
+// Package tracing instruments the live post-edit pipeline (the websocket
+// append/backspace/splice/close/image handlers and everything they call
+// into: parser, db and the thread update feed) with OpenTelemetry spans.
+// It mirrors the way Fabio wires up its Zipkin support: a small package
+// that owns a single global tracer, configured once at startup, and a
+// couple of helpers handlers call without having to think about exporters.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config controls whether the post-edit pipeline is traced and, if so, where
+// the resulting spans are exported to. Held by the config package through
+// config.GetTracing/config.SetTracing, not as a field of its main
+// configuration struct.
+type Config struct {
+	Enable bool `json:"enable"`
+
+	// Exporter selects the backend spans are shipped to: "jaeger", "zipkin"
+	// or "otlp".
+	Exporter string `json:"exporter"`
+
+	// CollectorURL is the exporter-specific collector endpoint.
+	CollectorURL string `json:"collectorURL"`
+
+	// ServiceName identifies this process in the exported spans.
+	ServiceName string `json:"serviceName"`
+
+	// SamplerRate is the fraction of traces recorded, from 0 to 1.
+	SamplerRate float64 `json:"samplerRate"`
+}
+
+// tracer is used for all spans started via StartSpan. Defaults to the
+// OpenTelemetry no-op tracer, so StartSpan is always safe to call, even if
+// Init was never invoked or tracing is disabled.
+var tracer = otel.Tracer("github.com/bakape/meguca")
+
+// Init configures the global tracer according to conf. Call once on server
+// startup, before any client connections are accepted. A disabled Config is
+// a NOP: StartSpan keeps working, but produces no-op spans.
+func Init(conf Config) error {
+	if !conf.Enable {
+		return nil
+	}
+
+	exp, err := newExporter(conf)
+	if err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+
+	res, err := resource.New(
+		context.Background(),
+		resource.WithAttributes(semconv.ServiceNameKey.String(conf.ServiceName)),
+	)
+	if err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.TraceIDRatioBased(conf.SamplerRate)),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer(conf.ServiceName)
+	return nil
+}
+
+// newExporter constructs the span exporter named by conf.Exporter.
+func newExporter(conf Config) (sdktrace.SpanExporter, error) {
+	switch conf.Exporter {
+	case "jaeger":
+		return jaeger.New(jaeger.WithCollectorEndpoint(
+			jaeger.WithEndpoint(conf.CollectorURL),
+		))
+	case "zipkin":
+		return zipkin.New(conf.CollectorURL)
+	case "otlp":
+		return otlptracegrpc.New(
+			context.Background(),
+			otlptracegrpc.WithEndpoint(conf.CollectorURL),
+			otlptracegrpc.WithInsecure(),
+		)
+	default:
+		return nil, fmt.Errorf("unknown exporter: %q", conf.Exporter)
+	}
+}
+
+// StartSpan starts a span named name as a child of ctx and returns the
+// derived context together with the span. The caller is expected to End
+// the span, typically via defer, once the traced operation completes.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (
+	context.Context, trace.Span,
+) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// RecordError records err on span and marks it as failed, if err is not
+// nil. Returns err unchanged, so it can be used as a passthrough, e.g.
+//
+//	return tracing.RecordError(span, c.updateBody(ctx, msg, 1))
+func RecordError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -2,17 +2,23 @@ package websockets
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"unicode/utf8"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"github.com/bakape/meguca/common"
 	"github.com/bakape/meguca/config"
 	"github.com/bakape/meguca/db"
 	"github.com/bakape/meguca/parser"
-	"github.com/bakape/meguca/util"
+	"github.com/bakape/meguca/pow"
+	"github.com/bakape/meguca/systempost"
+	"github.com/bakape/meguca/tracing"
 )
 
 var (
@@ -23,6 +29,11 @@ var (
 	errSpliceNOOP    = errors.New("splice NOOP")
 	errTextOnly      = errors.New("text only board")
 	errHasImage      = errors.New("post already has image")
+
+	// errPoWRequired is returned by requirePoWIfNeeded, when the client's
+	// spam score crossed the PoW threshold. The caller must abort the
+	// operation that triggered it; a challenge has already been sent.
+	errPoWRequired = errors.New("proof of work required")
 )
 
 // Error created, when client supplies invalid splice coordinates to server
@@ -82,8 +93,62 @@ func (s spliceRequest) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// spanAttrs returns the attributes recorded on each handler's top-level span
+// and on updateBody's span: post ID / board / op and the current body length.
+// The child spans around individual parser and db calls carry no attributes.
+func (c *Client) spanAttrs() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int64("post.id", int64(c.post.id)),
+		attribute.String("post.board", c.post.board),
+		attribute.Int64("post.op", int64(c.post.op)),
+		attribute.Int("post.body_len", c.post.len),
+	}
+}
+
+// Buffer pools for the open-post edit hot path. A connection with an open
+// post allocates fresh scratch buffers on every keystroke by default; these
+// let spliceText reuse them instead. appendRune and backspace edit
+// c.post.body in place and use neither pool.
+var (
+	runePool = sync.Pool{
+		New: func() any { return make([]rune, 0, 256) },
+	}
+	bufPool = sync.Pool{
+		New: func() any { return new(bytes.Buffer) },
+	}
+)
+
+// decodeRunes decodes the UTF-8 bytes of b into dst, reusing dst's backing
+// array, and returns the result. Replaces the []rune(string(b)) idiom, which
+// allocates twice over: once converting b to a string, once for the rune
+// slice.
+func decodeRunes(dst []rune, b []byte) []rune {
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		dst = append(dst, r)
+		b = b[size:]
+	}
+	return dst
+}
+
+// bodySnapshot returns a copy of the open post's body, safe for feed.
+// SetOpenBody and db.SetOpenBody to retain past the current call. c.post.body
+// itself keeps getting mutated in place by subsequent appends/splices, so
+// handing out the live slice here - instead of a copy - would let a later
+// in-place edit corrupt a buffer a concurrent feed reader still holds.
+func (c *Client) bodySnapshot() []byte {
+	return append([]byte(nil), c.post.body...)
+}
+
 // Append a rune to the body of the open post
 func (c *Client) appendRune(data []byte) (err error) {
+	ctx, span := tracing.StartSpan(context.Background(), "websockets.appendRune",
+		c.spanAttrs()...)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	has, err := c.hasPost()
 	switch {
 	case err != nil:
@@ -94,6 +159,10 @@ func (c *Client) appendRune(data []byte) (err error) {
 		return common.ErrBodyTooLong
 	}
 
+	if err = c.requirePoWIfNeeded("appendRune"); err != nil {
+		return
+	}
+
 	var char rune
 	err = decodeMessage(data, &char)
 	switch {
@@ -120,18 +189,22 @@ func (c *Client) appendRune(data []byte) (err error) {
 		return
 	}
 
-	c.post.body = append(c.post.body, string(char)...)
+	c.post.body = utf8.AppendRune(c.post.body, char)
 	c.post.len++
-	return c.updateBody(msg, 1)
+	return c.updateBody(ctx, msg, 1)
 }
 
 // Send message to thread update feed and writes the open post's buffer to the
 // embedded database. Requires locking of c.openPost.
 // n specifies the number of characters updated.
-func (c *Client) updateBody(msg []byte, n int) error {
-	c.feed.SetOpenBody(c.post.id, string(c.post.body), msg)
+func (c *Client) updateBody(ctx context.Context, msg []byte, n int) error {
+	_, span := tracing.StartSpan(ctx, "websockets.updateBody", c.spanAttrs()...)
+	defer span.End()
+
+	body := c.bodySnapshot()
+	c.feed.SetOpenBody(c.post.id, string(body), msg)
 	c.incrementSpamScore(uint(n) * config.Get().CharScore)
-	return db.SetOpenBody(c.post.id, c.post.body)
+	return tracing.RecordError(span, db.SetOpenBody(c.post.id, body))
 }
 
 // Increment the spam score for this IP by score. If the client requires a new
@@ -140,8 +213,83 @@ func (c *Client) incrementSpamScore(score uint) {
 	db.IncrementSpamScore(c.captchaSession, c.ip, score)
 }
 
+// requirePoWIfNeeded checks the client's spam score against the configured
+// PoW threshold and, if crossed, issues a proof-of-work challenge, with its
+// difficulty scaled for op, instead of letting the operation through.
+// appendRune, backspace, spliceText and insertImage call this before doing
+// any expensive work; closePost and spoilerImage do not. Returns
+// errPoWRequired, if a challenge was just issued and sent.
+func (c *Client) requirePoWIfNeeded(op string) error {
+	conf := config.GetPoW()
+	if !conf.Enable || conf.ScoreThreshold == 0 {
+		// A zero threshold has no valid score to scale the challenge
+		// difficulty against, so treat it the same as PoW being disabled,
+		// rather than issuing a challenge (or dividing by it) below.
+		return nil
+	}
+
+	score, err := db.GetSpamScore(c.captchaSession, c.ip)
+	if err != nil {
+		return err
+	}
+	if score < conf.ScoreThreshold {
+		return nil
+	}
+
+	chal, err := pow.Issue(c.powKey(), op, score/conf.ScoreThreshold)
+	if err != nil {
+		return err
+	}
+	msg, err := common.EncodeMessage(common.MessagePoWChallenge, chal)
+	if err != nil {
+		return err
+	}
+	if err := c.send(msg); err != nil {
+		return err
+	}
+	return errPoWRequired
+}
+
+// powKey identifies this client for PoW challenge issuance and redemption:
+// the captcha session, if one was established, falling back to the raw IP.
+func (c *Client) powKey() string {
+	if c.captchaSession != "" {
+		return c.captchaSession
+	}
+	return c.ip
+}
+
+// solvePoWSolution redeems a client-submitted proof-of-work solution. On
+// success, the configured score debit is applied, so a solved challenge
+// actually lowers the client back towards being allowed to post freely.
+//
+// Takes the payload of a common.MessagePoWSolution message. Client's message
+// dispatch switch does not route that message type to this method.
+func (c *Client) solvePoWSolution(data []byte) error {
+	var sol pow.Solution
+	err := decodeMessage(data, &sol)
+	if err != nil {
+		return err
+	}
+
+	err = pow.Redeem(c.powKey(), sol)
+	if err != nil {
+		return err
+	}
+
+	db.DecrementSpamScore(c.captchaSession, c.ip, config.GetPoW().ScoreDebit)
+	return nil
+}
+
 // Remove one character from the end of the line in the open post
-func (c *Client) backspace() error {
+func (c *Client) backspace() (err error) {
+	ctx, span := tracing.StartSpan(context.Background(), "websockets.backspace",
+		c.spanAttrs()...)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	has, err := c.hasPost()
 	switch {
 	case err != nil:
@@ -152,6 +300,10 @@ func (c *Client) backspace() error {
 		return errEmptyPost
 	}
 
+	if err = c.requirePoWIfNeeded("backspace"); err != nil {
+		return err
+	}
+
 	msg, err := common.EncodeMessage(common.MessageBackspace, c.post.id)
 	if err != nil {
 		return err
@@ -164,11 +316,18 @@ func (c *Client) backspace() error {
 	}
 	c.post.len--
 
-	return c.updateBody(msg, 1)
+	return c.updateBody(ctx, msg, 1)
 }
 
 // Close an open post and parse the last line, if needed.
 func (c *Client) closePost() (err error) {
+	ctx, span := tracing.StartSpan(context.Background(), "websockets.closePost",
+		c.spanAttrs()...)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	if c.post.id == 0 {
 		return errNoPostOpen
 	}
@@ -177,9 +336,18 @@ func (c *Client) closePost() (err error) {
 		com   []common.Command
 	)
 	if c.post.len != 0 {
-		if !parser.RegisterFilter(c.post.op, c.post.body) {
+		_, filterSpan := tracing.StartSpan(ctx, "parser.RegisterFilter")
+		registered := parser.RegisterFilter(c.post.op, c.post.body)
+		filterSpan.End()
+
+		if !registered {
 			oldLen := len(c.post.body)
-			if parser.ApplyFilters(c.post.op, &c.post.body) {
+
+			_, applySpan := tracing.StartSpan(ctx, "parser.ApplyFilters")
+			applied := parser.ApplyFilters(c.post.op, &c.post.body)
+			applySpan.End()
+
+			if applied {
 				var (
 					bodyStr = string(c.post.body)
 					msg     []byte
@@ -200,12 +368,17 @@ func (c *Client) closePost() (err error) {
 				if err != nil {
 					return
 				}
+				// Reuse the string copy already taken above for the message
+				// text instead of calling bodySnapshot for a second one.
 				c.feed.SetOpenBody(c.post.id, bodyStr, msg)
 			}
 		}
 
+		_, parseSpan := tracing.StartSpan(ctx, "parser.ParseBody")
 		links, com, err = parser.ParseBody(c.post.body, c.post.board, c.post.op,
 			c.post.id, c.ip, false)
+		tracing.RecordError(parseSpan, err)
+		parseSpan.End()
 		if err != nil {
 			return
 		}
@@ -216,7 +389,10 @@ func (c *Client) closePost() (err error) {
 				from = links[len(links)-1].ID
 				img  *common.Image
 			)
+			_, transferSpan := tracing.StartSpan(ctx, "db.TransferImage")
 			img, err = db.TransferImage(from, c.post.id, c.post.op)
+			tracing.RecordError(transferSpan, err)
+			transferSpan.End()
 			if err != nil {
 				return
 			}
@@ -224,23 +400,11 @@ func (c *Client) closePost() (err error) {
 				c.incrementSpamScore(config.Get().ImageScore)
 
 				var msg []byte
-				msg, err = common.EncodeMessage(
-					common.MessageStoleImageFrom,
-					from,
-				)
-				if err != nil {
-					return
-				}
-				c.feed.Send(msg)
-
-				msg, err = common.EncodeMessage(
-					common.MessageStoleImageTo,
-					struct {
-						ID    uint64        `json:"id"`
-						Image *common.Image `json:"image"`
-					}{
-						ID:    c.post.id,
-						Image: img,
+				msg, err = systempost.New(c.post.op, systempost.ImageStolen,
+					map[string]any{
+						"from":  from,
+						"to":    c.post.id,
+						"image": img,
 					},
 				)
 				if err != nil {
@@ -250,7 +414,10 @@ func (c *Client) closePost() (err error) {
 			}
 		}
 	}
+	_, closeSpan := tracing.StartSpan(ctx, "db.ClosePost")
 	err = db.ClosePost(c.post.id, c.post.op, string(c.post.body), links, com)
+	tracing.RecordError(closeSpan, err)
+	closeSpan.End()
 	if err != nil {
 		return
 	}
@@ -259,15 +426,26 @@ func (c *Client) closePost() (err error) {
 }
 
 // Splice the text in the open post
-func (c *Client) spliceText(data []byte) error {
+func (c *Client) spliceText(data []byte) (err error) {
+	ctx, span := tracing.StartSpan(context.Background(), "websockets.spliceText",
+		c.spanAttrs()...)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	if has, err := c.hasPost(); err != nil {
 		return err
 	} else if !has {
 		return nil
 	}
 
+	if err = c.requirePoWIfNeeded("spliceText"); err != nil {
+		return err
+	}
+
 	var req spliceRequest
-	err := decodeMessage(data, &req)
+	err = decodeMessage(data, &req)
 	if err != nil {
 		return err
 	}
@@ -305,10 +483,11 @@ func (c *Client) spliceText(data []byte) error {
 		}
 	}
 
-	var (
-		old = []rune(string(c.post.body))
-		end = append(req.Text, old[req.Start+req.Len:]...)
-	)
+	old := runePool.Get().([]rune)
+	old = decodeRunes(old[:0], c.post.body)
+	defer runePool.Put(old[:0])
+
+	end := append(req.Text, old[req.Start+req.Len:]...)
 	c.post.len += -int(req.Len) + len(req.Text)
 	res := spliceMessage{
 		ID: c.post.id,
@@ -332,15 +511,21 @@ func (c *Client) spliceText(data []byte) error {
 		return err
 	}
 
-	// Need to prevent modifications to the original slice, as there might be
-	// concurrent reads in the update feed.
-	c.post.body = util.CloneBytes(c.post.body)
-
-	byteStartPos := 0
+	// Rebuild the body in a pooled scratch buffer, then overwrite
+	// c.post.body's own backing array with the result in place. This is safe
+	// because bodySnapshot, not c.post.body itself, is what ever leaves this
+	// client: updateBody hands feed.SetOpenBody/db.SetOpenBody a copy taken
+	// before any further edit can reach this array.
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
 	for _, r := range old[:req.Start] {
-		byteStartPos += utf8.RuneLen(r)
+		buf.WriteRune(r)
+	}
+	for _, r := range end {
+		buf.WriteRune(r)
 	}
-	c.post.body = append(c.post.body[:byteStartPos], string(end)...)
+	c.post.body = append(c.post.body[:0], buf.Bytes()...)
+	bufPool.Put(buf)
 
 	c.post.countLines()
 	if c.post.lines > common.MaxLinesBody {
@@ -348,13 +533,20 @@ func (c *Client) spliceText(data []byte) error {
 	}
 
 	// +1, so you can't spam zero insert splices to infinity
-	return c.updateBody(msg, len(res.Text)+1)
+	return c.updateBody(ctx, msg, len(res.Text)+1)
 }
 
 // Insert and image into an existing open post
 // Note: Spam score is now incremented on image thumbnailing, not assignment to
 // post.
 func (c *Client) insertImage(data []byte) (err error) {
+	ctx, span := tracing.StartSpan(context.Background(), "websockets.insertImage",
+		c.spanAttrs()...)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	// Ensure this can not be spammed, as this function can be resolved into a
 	// NOP branch. It is generally good to have some spam protection either way.
 	c.incrementSpamScore(config.Get().CharScore)
@@ -367,7 +559,11 @@ func (c *Client) insertImage(data []byte) (err error) {
 		return errNoPostOpen
 	}
 
-	hasImage, err := c.hasImage()
+	if err = c.requirePoWIfNeeded("insertImage"); err != nil {
+		return
+	}
+
+	hasImage, err := c.hasImage(ctx)
 	if err != nil {
 		return
 	}
@@ -390,12 +586,15 @@ func (c *Client) insertImage(data []byte) (err error) {
 
 	formatImageName(&req.Name)
 
+	_, insertSpan := tracing.StartSpan(ctx, "db.InsertImage")
 	var msg []byte
 	err = db.InTransaction(false, func(tx *sql.Tx) (err error) {
 		msg, err = db.InsertImage(tx, c.post.id, req.Token, req.Name,
 			req.Spoiler)
 		return
 	})
+	tracing.RecordError(insertSpan, err)
+	insertSpan.End()
 	if err != nil {
 		return
 	}
@@ -408,8 +607,11 @@ func (c *Client) insertImage(data []byte) (err error) {
 
 // Check, if post has an image. Done through the DB, so the poster can reupload,
 // after his has been stolen.
-func (c *Client) hasImage() (has bool, err error) {
+func (c *Client) hasImage(ctx context.Context) (has bool, err error) {
+	_, span := tracing.StartSpan(ctx, "db.HasImage")
 	has, err = db.HasImage(c.post.id)
+	tracing.RecordError(span, err)
+	span.End()
 	if err != nil {
 		return
 	}
@@ -422,6 +624,13 @@ func (c *Client) hasImage() (has bool, err error) {
 
 // Spoiler an already inserted image in an unclosed post
 func (c *Client) spoilerImage() (err error) {
+	ctx, span := tracing.StartSpan(context.Background(), "websockets.spoilerImage",
+		c.spanAttrs()...)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	// Ensure this can not be spammed, as this function can be resolved into a
 	// NOP branch. It is generally good to have some spam protection either way.
 	c.incrementSpamScore(config.Get().CharScore)
@@ -434,7 +643,7 @@ func (c *Client) spoilerImage() (err error) {
 		return errNoPostOpen
 	}
 
-	hasImage, err := c.hasImage()
+	hasImage, err := c.hasImage(ctx)
 	if err != nil {
 		return
 	}
@@ -446,15 +655,25 @@ func (c *Client) spoilerImage() (err error) {
 		return nil
 	}
 
+	_, spoilerSpan := tracing.StartSpan(ctx, "db.SpoilerImage")
 	err = db.SpoilerImage(c.post.id, c.post.op)
+	tracing.RecordError(spoilerSpan, err)
+	spoilerSpan.End()
 	if err != nil {
 		return
 	}
-	msg, err := common.EncodeMessage(common.MessageSpoiler, c.post.id)
+	msg, err := systempost.New(c.post.op, systempost.ImageSpoilered,
+		map[string]any{
+			"id": c.post.id,
+		},
+	)
 	if err != nil {
 		return
 	}
-	c.feed.SpoilerImage(c.post.id, msg)
+	// Go through the same generic broadcast path closePost's #steal handling
+	// uses for system posts - feed.SpoilerImage expects the old MessageSpoiler
+	// wire format, not a MessageSystemPost payload.
+	c.feed.Send(msg)
 
 	return
 }
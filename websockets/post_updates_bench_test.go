@@ -0,0 +1,53 @@
+package websockets
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf8"
+)
+
+// BenchmarkSyntheticTypist simulates a typist on an open post: a run of
+// single-rune appends with an occasional splice in the middle of the body.
+// It exercises decodeRunes and the real runePool/bufPool spliceText uses, to
+// track allocs/op on the hot path. The appends use utf8.AppendRune, as
+// appendRune does.
+//
+// It can't call appendRune/spliceText themselves: both are methods on
+// *Client, and constructing one needs the db/config/feed dependencies
+// client.go wires up, none of which are part of this package's files in
+// this tree. The splice rebuild loop below is copied from spliceText's and
+// will silently drift from it if that method's rebuild logic ever changes -
+// replace this benchmark with one that drives a real *Client once those
+// dependencies are available to tests in this package.
+func BenchmarkSyntheticTypist(b *testing.B) {
+	const sentence = "The quick brown fox jumps over the lazy dog"
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		body := make([]byte, 0, 128)
+		for _, r := range sentence {
+			body = utf8.AppendRune(body, r)
+		}
+
+		old := runePool.Get().([]rune)
+		old = decodeRunes(old[:0], body)
+
+		const start, replaceLen = 4, 5 // splice out "quick"
+		end := append([]rune("slow"), old[start+replaceLen:]...)
+
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		for _, r := range old[:start] {
+			buf.WriteRune(r)
+		}
+		for _, r := range end {
+			buf.WriteRune(r)
+		}
+		body = append(body[:0], buf.Bytes()...)
+
+		bufPool.Put(buf)
+		runePool.Put(old[:0])
+
+		_ = body
+	}
+}